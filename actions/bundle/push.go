@@ -0,0 +1,255 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package bundle implements `k6 bundle push`, the write-side companion of
+// the oci:// import scheme in the loader package: it tars up a script
+// directory and pushes it to an OCI-compliant registry as a
+// loader.BundleMediaType layer.
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/loadimpact/k6/loader"
+	"github.com/loadimpact/speedboat/client"
+)
+
+func init() {
+	client.RegisterCommand(cli.Command{
+		Name:  "bundle",
+		Usage: "Manage OCI test bundles",
+		Subcommands: []cli.Command{
+			{
+				Name:      "push",
+				Usage:     "Tar a script directory and push it as an oci:// bundle",
+				ArgsUsage: "<dir>",
+				Action:    actionPush,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "tag, t",
+						Usage: "oci://registry/repo:tag to push to",
+					},
+					cli.StringFlag{
+						Name:  "entrypoint, e",
+						Usage: "script path within dir that oci:// imports with no #fragment should load",
+					},
+				},
+			},
+		},
+	})
+}
+
+func actionPush(c *cli.Context) {
+	dir := c.Args().First()
+	if dir == "" {
+		log.Fatal("A directory to bundle is required")
+	}
+	tag := c.String("tag")
+	if tag == "" {
+		log.Fatal("--tag oci://registry/repo:tag is required")
+	}
+	ref, err := parseTag(tag)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid --tag")
+	}
+
+	layer, digest, err := buildLayer(dir)
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't build bundle layer")
+	}
+
+	if err := pushBlob(ref, digest, layer); err != nil {
+		log.WithError(err).Fatal("Couldn't push bundle layer")
+	}
+
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"layers": []map[string]interface{}{
+			{
+				"mediaType": loader.BundleMediaType,
+				"digest":    digest,
+				"size":      len(layer),
+			},
+		},
+	}
+	if entrypoint := c.String("entrypoint"); entrypoint != "" {
+		manifest["annotations"] = map[string]string{loader.EntrypointAnnotation: entrypoint}
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't build manifest")
+	}
+
+	if err := pushManifest(ref, manifestBytes); err != nil {
+		log.WithError(err).Fatal("Couldn't push manifest")
+	}
+
+	log.WithFields(log.Fields{
+		"ref":    tag,
+		"digest": digest,
+	}).Info("Pushed bundle")
+}
+
+type ociRef struct {
+	Registry string
+	Repo     string
+	Tag      string
+}
+
+// parseTag accepts either a bare "registry/repo:tag" or an
+// "oci://registry/repo:tag" reference, since that's what users will be
+// copy-pasting out of their scripts' import statements.
+func parseTag(tag string) (ociRef, error) {
+	tag = strings.TrimPrefix(tag, "oci://")
+	slash := strings.IndexByte(tag, '/')
+	if slash == -1 {
+		return ociRef{}, fmt.Errorf("expected registry/repo:tag, got %q", tag)
+	}
+	registry := tag[:slash]
+	repoTag := tag[slash+1:]
+
+	repo, version := repoTag, "latest"
+	if idx := strings.LastIndexByte(repoTag, ':'); idx != -1 {
+		repo, version = repoTag[:idx], repoTag[idx+1:]
+	}
+	if repo == "" {
+		return ociRef{}, fmt.Errorf("expected registry/repo:tag, got %q", tag)
+	}
+	return ociRef{Registry: registry, Repo: repo, Tag: version}, nil
+}
+
+// buildLayer tars and gzips dir, returning the resulting bytes alongside
+// their sha256 digest in OCI's "sha256:<hex>" form.
+func buildLayer(dir string) (layer []byte, digest string, err error) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	err = filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name: filepath.ToSlash(rel),
+			Mode: 0o644,
+			Size: int64(len(data)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, "", err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	layer = buf.Bytes()
+	sum := sha256.Sum256(layer)
+	digest = "sha256:" + hex.EncodeToString(sum[:])
+	return layer, digest, nil
+}
+
+// pushBlob uploads layer as ref's blob with the given digest, using the
+// registry's two-step (POST then PUT) monolithic upload.
+func pushBlob(ref ociRef, digest string, layer []byte) error {
+	startURL := fmt.Sprintf("https://%s/v2/%s/blobs/uploads/", ref.Registry, ref.Repo)
+	startReq, err := http.NewRequest(http.MethodPost, startURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := loader.DoRegistryRequest(startReq, ref.Registry)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("registry returned %d starting upload to %s", resp.StatusCode, startURL)
+	}
+
+	uploadURL := resp.Header.Get("Location")
+	sep := "?"
+	if strings.Contains(uploadURL, "?") {
+		sep = "&"
+	}
+	uploadURL += sep + "digest=" + digest
+
+	req, err := http.NewRequest(http.MethodPut, uploadURL, bytes.NewReader(layer))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	putResp, err := loader.DoRegistryRequest(req, ref.Registry)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = putResp.Body.Close() }()
+	if putResp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("registry returned %d completing upload to %s", putResp.StatusCode, uploadURL)
+	}
+	return nil
+}
+
+func pushManifest(ref ociRef, manifest []byte) error {
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repo, ref.Tag)
+	req, err := http.NewRequest(http.MethodPut, manifestURL, bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+
+	resp, err := loader.DoRegistryRequest(req, ref.Registry)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("registry returned %d pushing manifest to %s", resp.StatusCode, manifestURL)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+//go:build !windows
+// +build !windows
+
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package run
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNewReloadTriggerFiresOnSIGHUP checks that the trigger returned for
+// this process's own SIGHUP fires exactly once per signal, and that
+// stop() releases it so a later SIGHUP to the test binary doesn't leak
+// into a subsequent test.
+func TestNewReloadTriggerFiresOnSIGHUP(t *testing.T) {
+	reload, stop := newReloadTrigger("irrelevant.json")
+	defer stop()
+
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGHUP))
+
+	select {
+	case <-reload:
+	case <-time.After(time.Second):
+		t.Fatal("reload trigger didn't fire after SIGHUP")
+	}
+
+	select {
+	case <-reload:
+		t.Fatal("reload trigger fired a second time for a single SIGHUP")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestNewReloadTriggerStop checks that stop() actually unregisters the
+// signal handler, so a SIGHUP delivered afterwards doesn't reach a
+// channel nothing is listening on.
+func TestNewReloadTriggerStop(t *testing.T) {
+	reload, stop := newReloadTrigger("irrelevant.json")
+	stop()
+
+	// Keep another listener registered for the SIGHUP below; with none
+	// left at all, its default action would terminate the test binary.
+	sink := make(chan os.Signal, 1)
+	signal.Notify(sink, syscall.SIGHUP)
+	defer signal.Stop(sink)
+
+	assert.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGHUP))
+
+	select {
+	case <-reload:
+		t.Fatal("reload trigger fired after stop()")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
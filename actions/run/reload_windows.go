@@ -0,0 +1,65 @@
+//go:build windows
+// +build windows
+
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package run
+
+import (
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// newReloadTrigger returns a channel that receives a value whenever
+// filename's config should be reloaded, and a stop function to release
+// the OS resources it used. Windows has no SIGHUP (see reload_unix.go for
+// the Unix equivalent), so instead this starts a local HTTP control
+// endpoint on 127.0.0.1: a POST to /reload triggers exactly the same
+// reload a SIGHUP would elsewhere. If the endpoint can't be started, live
+// reload is disabled for the run rather than silently never firing.
+func newReloadTrigger(filename string) (<-chan struct{}, func()) {
+	reload := make(chan struct{}, 1)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.WithError(err).Error("Couldn't start reload control endpoint; live reload is disabled for this run")
+		return reload, func() {}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(ln) }()
+
+	log.WithFields(log.Fields{
+		"addr": ln.Addr().String(),
+	}).Info("Live reload: POST /reload to this address to reload the config (Windows has no SIGHUP)")
+
+	return reload, func() { _ = srv.Close() }
+}
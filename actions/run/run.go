@@ -1,18 +1,33 @@
 package run
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
+	"github.com/loadimpact/k6/loader"
 	"github.com/loadimpact/speedboat/client"
 	"github.com/loadimpact/speedboat/comm"
 	"github.com/loadimpact/speedboat/common"
 	"github.com/loadimpact/speedboat/loadtest"
 	"github.com/loadimpact/speedboat/runner"
+	"github.com/spf13/afero"
 	"io/ioutil"
 	"path"
 	"time"
 )
 
+// errReloadScriptChanged is returned by reloadTest when a reload trigger
+// (see newReloadTrigger) fires with a config that would change the
+// test's Script; hot-swapping script source mid-run is out of scope, so
+// such a reload is rejected instead of silently applied.
+var errReloadScriptChanged = errors.New("script changed; reload only applies to VUs, duration and stages")
+
 func init() {
 	client.RegisterCommand(cli.Command{
 		Name:   "run",
@@ -35,24 +50,170 @@ func init() {
 				Usage: "Duration of the test",
 				Value: "10s",
 			},
+			cli.BoolFlag{
+				Name:  "reload-dry-run",
+				Usage: "On a reload trigger, log the reloaded config's diff instead of applying it",
+			},
+			cli.StringFlag{
+				Name:  "import-root",
+				Usage: "Directory file:// imports are sandboxed to (default: the script's own directory)",
+			},
+			cli.StringSliceFlag{
+				Name:  "import-allow",
+				Usage: "Additional directories file:// imports may reach outside --import-root",
+			},
+			cli.BoolFlag{
+				Name:  "offline",
+				Usage: "Force cache-only resolution of imports; fail instead of reaching the network on a cache miss",
+			},
+			cli.IntFlag{
+				Name:  "prefetch-concurrency",
+				Usage: "Worker pool size for prefetching imports before the run starts (default: GOMAXPROCS)",
+			},
 		},
 	})
 }
 
-func actionRun(c *cli.Context) {
-	ct, _ := common.MustGetClient(c)
-	in, out := ct.Run()
+// rawCachesConfig is the subset of the test config file this package
+// parses itself, alongside (and independently of) loadtest.ParseConfig:
+// the `caches` section isn't part of loadtest.Config, so it's read
+// straight out of the same bytes instead.
+type rawCachesConfig struct {
+	Caches map[string]loader.BucketConfig `json:"caches"`
+}
 
-	filename := c.Args()[0]
-	conf := loadtest.NewConfig()
-	if len(c.Args()) > 0 {
-		data, err := ioutil.ReadFile(filename)
-		if err != nil {
-			log.WithError(err).Fatal("Couldn't read test file")
+// installCache builds a loader.Cache from filename's `caches` section (if
+// it has one) and installs it with loader.SetCache, so every https://
+// import - whether resolved by PrefetchGraph or by the opaque
+// loadtest.Test.Load - transparently reads through it. A config with no
+// `caches` section, or one that isn't valid JSON, leaves caching off
+// rather than failing the run: the cache is a performance feature, not a
+// required one.
+func installCache(c *cli.Context, filename string) *loader.Cache {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+
+	var raw rawCachesConfig
+	if err := json.Unmarshal(data, &raw); err != nil {
+		log.WithError(err).Warn("Couldn't parse `caches` section, import caching is off")
+		return nil
+	}
+	if len(raw.Caches) == 0 {
+		return nil
+	}
+
+	cache, err := loader.NewCache(raw.Caches, path.Dir(filename))
+	if err != nil {
+		log.WithError(err).Warn("Couldn't set up import cache, caching is off")
+		return nil
+	}
+	cache.Offline = c.Bool("offline")
+	loader.SetCache(cache)
+	return cache
+}
+
+// prefetchImports walks conf's script and its transitive imports with
+// loader.PrefetchGraph before the compiler's serial Load calls reach
+// them, so a cold cache pays for its round-trips in parallel instead of
+// one import at a time. It's best-effort: any error here - including the
+// root script itself not being readable - is logged and otherwise
+// ignored, since conf.Compile/test.Load loads the very same imports again
+// right afterwards, serially, and will fail there with a clearer,
+// per-import error if something's actually broken.
+func prefetchImports(conf loadtest.Config, filename string, concurrency int) {
+	var root *url.URL
+	var err error
+	if strings.Contains(conf.Script, "://") {
+		root, err = url.Parse(conf.Script)
+	} else {
+		scriptPath := conf.Script
+		if !path.IsAbs(scriptPath) {
+			scriptPath = path.Join(path.Dir(filename), scriptPath)
 		}
+		root = &url.URL{Scheme: "file", Path: scriptPath}
+	}
+	if err != nil {
+		log.WithError(err).Debug("Couldn't resolve script for prefetch, skipping")
+		return
+	}
 
-		loadtest.ParseConfig(data, &conf)
+	filesystems := map[string]afero.Fs{}
+	var src []byte
+	if root.Scheme == "file" {
+		src, err = ioutil.ReadFile(root.Path)
+	} else {
+		var sd *loader.SourceData
+		sd, err = loader.Load(filesystems, root, conf.Script)
+		if err == nil {
+			src = sd.Data
+		}
 	}
+	if err != nil {
+		log.WithError(err).Debug("Couldn't read script for prefetch, skipping")
+		return
+	}
+
+	progress := make(chan loader.PrefetchProgress, 16)
+	done := make(chan struct{})
+	go logPrefetchProgress(progress, done)
+
+	err = loader.PrefetchGraph(root, src, filesystems, loader.PrefetchOpts{
+		Concurrency: concurrency,
+		Progress:    progress,
+	})
+	close(progress)
+	<-done
+	if err != nil {
+		log.WithError(err).Warn("Prefetching imports had errors; the run will retry them serially")
+	}
+}
+
+// logPrefetchProgress drains progress, logging a running discovered/
+// completed/bytes tally as the prefetch worker pool makes headway - a
+// lightweight stand-in for a progress bar that doesn't require pulling in
+// a terminal-rendering dependency.
+func logPrefetchProgress(progress <-chan loader.PrefetchProgress, done chan<- struct{}) {
+	defer close(done)
+	for p := range progress {
+		log.WithFields(log.Fields{
+			"discovered": p.Discovered,
+			"completed":  p.Completed,
+			"bytes":      p.Bytes,
+		}).Info("Prefetching imports")
+	}
+}
+
+// installSandbox chroots file:// imports to --import-root (or, absent
+// that flag, the script's own directory) plus any --import-allow
+// directories, so a script can't escape its own directory tree via "..",
+// an absolute path, or a symlink.
+func installSandbox(c *cli.Context, filename string) error {
+	root := c.String("import-root")
+	if root == "" {
+		root = path.Dir(filename)
+	}
+	sb, err := loader.NewSandbox(root, c.StringSlice("import-allow")...)
+	if err != nil {
+		return err
+	}
+	loader.SetSandbox(sb)
+	return nil
+}
+
+// loadConfig reads filename and layers the CLI flags given in c on top of
+// it, exactly as actionRun does at startup. Reusing it for reload-trigger
+// reloads means a reload sees the same config a fresh run of the same
+// command would.
+func loadConfig(c *cli.Context, filename string) (loadtest.Config, error) {
+	conf := loadtest.NewConfig()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return conf, err
+	}
+	loadtest.ParseConfig(data, &conf)
 
 	if c.IsSet("script") {
 		conf.Script = c.String("script")
@@ -64,6 +225,75 @@ func actionRun(c *cli.Context) {
 		conf.VUs = c.Int("vus")
 	}
 
+	return conf, nil
+}
+
+// reloadTest re-reads filename and compiles it into a *loadtest.Test that
+// can replace the active one without tearing down running VUs. Changing
+// Script across a reload isn't supported, since hot-swapping script
+// source mid-run would invalidate in-flight iterations; such a reload is
+// rejected rather than silently ignored.
+func reloadTest(c *cli.Context, filename string, current *loadtest.Test) (*loadtest.Test, error) {
+	conf, err := loadConfig(c, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := conf.Compile()
+	if err != nil {
+		return nil, err
+	}
+	if next.Script != current.Script {
+		return nil, errReloadScriptChanged
+	}
+
+	if err := next.Load(path.Dir(filename)); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// diffReload describes what a reload would change in current's schedule
+// by comparing it stage-by-stage against next, so --reload-dry-run can
+// report what's actually different instead of dumping the whole
+// recompiled test. reloadTest has already rejected any Script change by
+// the time this runs, so it only ever needs to speak to VUs/Duration/
+// stages.
+func diffReload(current, next *loadtest.Test) string {
+	var diffs []string
+	switch {
+	case len(current.Stages) != len(next.Stages):
+		diffs = append(diffs, fmt.Sprintf("stages: %d -> %d", len(current.Stages), len(next.Stages)))
+	default:
+		for i := range current.Stages {
+			if !reflect.DeepEqual(current.Stages[i], next.Stages[i]) {
+				diffs = append(diffs, fmt.Sprintf("stage[%d]: %+v -> %+v", i, current.Stages[i], next.Stages[i]))
+			}
+		}
+	}
+	if len(diffs) == 0 {
+		return "no changes"
+	}
+	return strings.Join(diffs, "; ")
+}
+
+func actionRun(c *cli.Context) {
+	ct, _ := common.MustGetClient(c)
+	in, out := ct.Run()
+
+	filename := c.Args()[0]
+	if err := installSandbox(c, filename); err != nil {
+		log.WithError(err).Fatal("Couldn't set up --import-root sandbox")
+	}
+	installCache(c, filename)
+
+	conf, err := loadConfig(c, filename)
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't read test file")
+	}
+
+	prefetchImports(conf, filename, c.Int("prefetch-concurrency"))
+
 	log.WithField("conf", conf).Info("Config")
 	test, err := conf.Compile()
 	if err != nil {
@@ -81,6 +311,10 @@ func actionRun(c *cli.Context) {
 		VUs:      test.Stages[0].VUs.Start,
 	})
 
+	reloadDryRun := c.Bool("reload-dry-run")
+	reload, stopReload := newReloadTrigger(filename)
+	defer stopReload()
+
 	startTime := time.Now()
 	intervene := time.Tick(time.Duration(1) * time.Second)
 	sequencer := runner.NewSequencer()
@@ -88,6 +322,18 @@ func actionRun(c *cli.Context) {
 runLoop:
 	for {
 		select {
+		case <-reload:
+			next, err := reloadTest(c, filename, test)
+			if err != nil {
+				log.WithError(err).Error("Couldn't reload config, keeping current one")
+				break
+			}
+			if reloadDryRun {
+				log.WithField("diff", diffReload(test, next)).Info("Reload (dry run): would apply this schedule")
+				break
+			}
+			test = next
+			log.WithField("test", test).Info("Reloaded config")
 		case msg := <-in:
 			switch msg.Type {
 			case "test.log":
@@ -136,4 +382,4 @@ runLoop:
 		"avg": stats.Duration.Avg,
 		"med": stats.Duration.Med,
 	}).Info("Duration")
-}
\ No newline at end of file
+}
@@ -0,0 +1,169 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package run
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/loadimpact/speedboat/loadtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPrefetchImportsLocalScript checks that prefetchImports resolves a
+// local script relative to the config file's own directory and doesn't
+// error when the script has no imports to walk - the trivial case every
+// plain `k6 run script.js` invocation hits.
+func TestPrefetchImportsLocalScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k6-prefetch-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "script.js"), []byte("export default function() {};"), 0o644))
+	configPath := writeTestConfig(t, dir, "script.js")
+
+	conf, err := loadConfig(newTestContext(t), configPath)
+	require.NoError(t, err)
+
+	assert.NotPanics(t, func() { prefetchImports(conf, configPath, 1) })
+}
+
+func writeCachesConfig(t *testing.T, dir string) string {
+	t.Helper()
+	cacheDir := filepath.Join(dir, "cache")
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{
+		"script": "script.js",
+		"caches": {"imports": {"dir": "`+cacheDir+`", "maxAge": 3600000000000}}
+	}`), 0o644))
+	return path
+}
+
+// newTestContext builds a bare *cli.Context carrying none of the run
+// flags set, matching what reloadTest sees on a SIGHUP: the original
+// invocation's flags, not whatever a fresh `k6 run` would default to.
+func newTestContext(t *testing.T) *cli.Context {
+	t.Helper()
+	return cli.NewContext(nil, flag.NewFlagSet("test", flag.ContinueOnError), nil)
+}
+
+// newTestContextWithOffline is newTestContext, but with --offline parsed
+// as set, for installCache's "fail closed" behavior.
+func newTestContextWithOffline(t *testing.T) *cli.Context {
+	t.Helper()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.Bool("offline", false, "")
+	require.NoError(t, set.Parse([]string{"-offline"}))
+	return cli.NewContext(nil, set, nil)
+}
+
+func writeTestConfig(t *testing.T, dir, script string) string {
+	t.Helper()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "script.js"), []byte("export default function() {};"), 0o644))
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"script": "`+script+`", "vus": 1, "duration": "1s"}`), 0o644))
+	return path
+}
+
+// TestReloadTestRejectsScriptChange checks that a SIGHUP reload whose
+// config names a different Script than the running test is rejected with
+// errReloadScriptChanged rather than applied; hot-swapping script source
+// mid-run is out of scope. The rejection happens before reloadTest ever
+// calls next.Load, so this doesn't depend on the script actually being
+// loadable.
+func TestReloadTestRejectsScriptChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k6-run-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	configPath := writeTestConfig(t, dir, "script.js")
+	current := &loadtest.Test{Script: "other.js"}
+
+	next, err := reloadTest(newTestContext(t), configPath, current)
+	assert.Nil(t, next)
+	assert.Equal(t, errReloadScriptChanged, err)
+}
+
+// TestReloadTestMissingConfig checks that reloadTest surfaces the read
+// error for a config file that no longer exists (e.g. deleted between
+// startup and a later SIGHUP) instead of panicking or silently keeping
+// the old schedule - that's reloadTest's caller's job, logged and
+// otherwise ignored.
+func TestReloadTestMissingConfig(t *testing.T) {
+	current := &loadtest.Test{Script: "script.js"}
+
+	next, err := reloadTest(newTestContext(t), "/no/such/config.json", current)
+	assert.Nil(t, next)
+	assert.Error(t, err)
+}
+
+// TestInstallCacheParsesCachesSection checks that installCache reads the
+// config file's `caches` section (which isn't part of loadtest.Config,
+// and so isn't reachable through loadConfig) into a real loader.Cache with
+// --offline threaded through, instead of the feature being unreachable
+// from a `k6 run` invocation.
+func TestInstallCacheParsesCachesSection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k6-run-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	configPath := writeCachesConfig(t, dir)
+
+	cache := installCache(newTestContextWithOffline(t), configPath)
+	require.NotNil(t, cache)
+	assert.True(t, cache.Offline)
+}
+
+// TestInstallCacheNoSection checks that a config file with no `caches`
+// section leaves caching off rather than erroring - it's an optional
+// performance feature, not a required one.
+func TestInstallCacheNoSection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k6-run-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	configPath := writeTestConfig(t, dir, "script.js")
+
+	assert.Nil(t, installCache(newTestContext(t), configPath))
+}
+
+// TestDiffReloadReportsStageChanges checks that diffReload describes what
+// changed between two schedules instead of (as the dry-run log used to)
+// dumping the entire recompiled test regardless of whether anything in it
+// actually differs.
+func TestDiffReloadReportsStageChanges(t *testing.T) {
+	current := &loadtest.Test{
+		Script: "script.js",
+		Stages: []loadtest.Stage{{VUs: loadtest.VURange{Start: 1, End: 1}}},
+	}
+	next := &loadtest.Test{
+		Script: "script.js",
+		Stages: []loadtest.Stage{{VUs: loadtest.VURange{Start: 1, End: 5}}},
+	}
+
+	assert.Contains(t, diffReload(current, next), "stage[0]")
+	assert.Equal(t, "no changes", diffReload(current, current))
+}
@@ -0,0 +1,341 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// Sentinel values for BucketConfig.MaxAge, matching the `caches` config
+// section: -1 (CacheForever) means entries never expire, zero disables
+// caching for the bucket entirely (every Load is a live fetch).
+const (
+	CacheForever  time.Duration = -1
+	CacheDisabled time.Duration = 0
+)
+
+// ErrOffline is returned by Cache.Fetch when --offline is set and the
+// requested URL isn't already present in the on-disk cache.
+var ErrOffline = errors.New("offline: no cached copy available and network access is disabled")
+
+// BucketConfig is one named entry of the test config's `caches` section,
+// e.g. the "imports" or "openData" bucket.
+type BucketConfig struct {
+	// Dir is the on-disk location of the bucket. It may contain the
+	// placeholders `:cacheDir` and `:resourceDir`, which are resolved
+	// against the OS cache directory and the test's resource directory
+	// respectively before the bucket is opened.
+	Dir string `json:"dir"`
+	// MaxAge is how long a cached entry is served without revalidation.
+	// CacheForever (-1) never expires it, CacheDisabled (0) turns the
+	// bucket into a pass-through.
+	MaxAge time.Duration `json:"maxAge"`
+	// Hosts overrides MaxAge for specific hosts within this bucket.
+	Hosts map[string]time.Duration `json:"hosts,omitempty"`
+}
+
+// resolveCacheDir expands the `:cacheDir`/`:resourceDir` placeholders a
+// bucket's Dir may use, so config files don't have to hardcode absolute,
+// OS-specific paths.
+func resolveCacheDir(dir, resourceDir string) (string, error) {
+	switch {
+	case strings.HasPrefix(dir, ":cacheDir"):
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return "", errors.Wrap(err, "resolving :cacheDir")
+		}
+		return filepath.Join(base, "k6", strings.TrimPrefix(dir, ":cacheDir")), nil
+	case strings.HasPrefix(dir, ":resourceDir"):
+		return filepath.Join(resourceDir, strings.TrimPrefix(dir, ":resourceDir")), nil
+	default:
+		return dir, nil
+	}
+}
+
+// entryMeta is the JSON sidecar stored next to a cached body, recording
+// enough of the response to revalidate it later.
+type entryMeta struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+}
+
+// Cache is a consolidated, persistent, per-bucket HTTP cache for remote
+// module imports, modeled on Hugo's cache of the same name. Each bucket is
+// backed by its own afero.Fs (normally an afero.OsFs rooted at the
+// resolved bucket directory), so Load can transparently read through it
+// without knowing whether a given body came from disk or the network.
+type Cache struct {
+	buckets map[string]afero.Fs
+	configs map[string]BucketConfig
+	client  *http.Client
+	// Offline forces cache-only resolution: a miss returns ErrOffline
+	// instead of reaching out to the network.
+	Offline bool
+}
+
+// NewCache builds a Cache from the `caches` section of a test config.
+// resourceDir resolves any `:resourceDir` placeholders in bucket dirs.
+func NewCache(configs map[string]BucketConfig, resourceDir string) (*Cache, error) {
+	buckets := make(map[string]afero.Fs, len(configs))
+	for name, cfg := range configs {
+		dir, err := resolveCacheDir(cfg.Dir, resourceDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cache bucket %q", name)
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, errors.Wrapf(err, "cache bucket %q", name)
+		}
+		buckets[name] = afero.NewBasePathFs(afero.NewOsFs(), dir)
+	}
+	return &Cache{buckets: buckets, configs: configs, client: http.DefaultClient}, nil
+}
+
+// Fs adapts bucket of c into an afero.Fs that can be installed directly
+// into a Load filesystems map under the "https" key - this is what makes
+// the cache "transparent": for such a map, loadRemote doesn't call
+// Cache.Fetch itself, it just notices filesystems["https"] is one of these
+// and reads through it,
+// so a caller that wants the default uncached behavior can still pass a
+// plain afero.Fs (or none at all) exactly as before.
+func (c *Cache) Fs(bucket string) afero.Fs {
+	return &cacheFs{Fs: c.buckets[bucket], cache: c, bucket: bucket}
+}
+
+// cacheFs is the afero.Fs Cache.Fs returns. It embeds the bucket's
+// on-disk directory Fs so every method other than Open behaves like a
+// plain afero.BasePathFs; Open is overridden to treat name as the URL
+// being imported and resolve it through Cache.Fetch instead of the
+// directory directly.
+type cacheFs struct {
+	afero.Fs
+	cache  *Cache
+	bucket string
+}
+
+func (f *cacheFs) Open(name string) (afero.File, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	src, err := f.cache.Fetch(f.bucket, u)
+	if err != nil {
+		return nil, err
+	}
+
+	mem := afero.NewMemMapFs()
+	if err := afero.WriteFile(mem, name, src.Data, 0o644); err != nil {
+		return nil, err
+	}
+	return mem.Open(name)
+}
+
+// maxAgeFor returns the effective MaxAge for u within bucket, honoring any
+// per-host override.
+func (c *Cache) maxAgeFor(bucket string, u *url.URL) time.Duration {
+	cfg := c.configs[bucket]
+	if override, ok := cfg.Hosts[u.Host]; ok {
+		return override
+	}
+	return cfg.MaxAge
+}
+
+// entryPaths returns the on-disk paths used to store u's body and metadata
+// within bucket, derived from the URL so repeated fetches of the same
+// import collide on the same cache entry.
+func entryPaths(u *url.URL) (body, meta string) {
+	key := strings.TrimPrefix(path.Join(u.Host, u.Path), "/")
+	if key == "" {
+		key = "root"
+	}
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return key, key + ".meta.json"
+}
+
+// Fetch resolves u through bucket, serving a fresh on-disk copy without
+// touching the network, conditionally revalidating a stale one with
+// If-None-Match/If-Modified-Since, and falling back to a plain GET when
+// there's nothing cached yet. It returns ErrOffline on a miss when
+// c.Offline is set.
+func (c *Cache) Fetch(bucket string, u *url.URL) (*SourceData, error) {
+	fs, ok := c.buckets[bucket]
+	if !ok {
+		if c.Offline {
+			return nil, ErrOffline
+		}
+		return c.liveFetch(u, nil)
+	}
+
+	maxAge := c.maxAgeFor(bucket, u)
+	bodyPath, metaPath := entryPaths(u)
+
+	if maxAge != CacheDisabled {
+		if data, meta, err := readEntry(fs, bodyPath, metaPath); err == nil {
+			if maxAge == CacheForever || time.Since(meta.FetchedAt) < maxAge {
+				return &SourceData{URL: u, Data: data}, nil
+			}
+			if c.Offline {
+				return &SourceData{URL: u, Data: data}, nil
+			}
+			revalidated, fresh, err := c.revalidate(u, meta)
+			if err == nil {
+				if fresh {
+					meta.FetchedAt = time.Now()
+					_ = writeEntry(fs, bodyPath, metaPath, data, meta)
+					return &SourceData{URL: u, Data: data}, nil
+				}
+				_ = writeEntry(fs, bodyPath, metaPath, revalidated.Data, revalidated.meta)
+				return &SourceData{URL: u, Data: revalidated.Data}, nil
+			}
+			// Revalidation failed (offline, DNS down, ...): serve stale
+			// rather than fail the whole test run.
+			return &SourceData{URL: u, Data: data}, nil
+		}
+	}
+
+	if c.Offline {
+		return nil, ErrOffline
+	}
+
+	src, meta, err := c.liveFetchWithMeta(u)
+	if err != nil {
+		return nil, err
+	}
+	if maxAge != CacheDisabled {
+		meta.FetchedAt = time.Now()
+		_ = writeEntry(fs, bodyPath, metaPath, src.Data, meta)
+	}
+	return src, nil
+}
+
+type revalidateResult struct {
+	Data []byte
+	meta entryMeta
+}
+
+// revalidate issues a conditional GET for u using the ETag/Last-Modified
+// recorded in meta. fresh is true on a 304 (the cached body is still
+// good); otherwise the new body and metadata are returned.
+func (c *Cache) revalidate(u *url.URL, meta entryMeta) (result revalidateResult, fresh bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return result, false, err
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return result, false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return result, true, nil
+	}
+	if resp.StatusCode >= 400 {
+		return result, false, fmt.Errorf("unexpected status %d for %s", resp.StatusCode, u)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return result, false, err
+	}
+	return revalidateResult{Data: data, meta: metaFromResponse(resp)}, false, nil
+}
+
+func (c *Cache) liveFetchWithMeta(u *url.URL) (*SourceData, entryMeta, error) {
+	resp, err := c.client.Get(u.String())
+	if err != nil {
+		return nil, entryMeta{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= 400 {
+		return nil, entryMeta{}, fmt.Errorf("unexpected status %d for %s", resp.StatusCode, u)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, entryMeta{}, err
+	}
+	return &SourceData{URL: u, Data: data}, metaFromResponse(resp), nil
+}
+
+func (c *Cache) liveFetch(u *url.URL, _ *entryMeta) (*SourceData, error) {
+	src, _, err := c.liveFetchWithMeta(u)
+	return src, err
+}
+
+func metaFromResponse(resp *http.Response) entryMeta {
+	return entryMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		FetchedAt:    time.Now(),
+	}
+}
+
+func readEntry(fs afero.Fs, bodyPath, metaPath string) ([]byte, entryMeta, error) {
+	data, err := afero.ReadFile(fs, bodyPath)
+	if err != nil {
+		return nil, entryMeta{}, err
+	}
+	rawMeta, err := afero.ReadFile(fs, metaPath)
+	if err != nil {
+		return nil, entryMeta{}, err
+	}
+	var meta entryMeta
+	if err := json.Unmarshal(rawMeta, &meta); err != nil {
+		return nil, entryMeta{}, err
+	}
+	return data, meta, nil
+}
+
+func writeEntry(fs afero.Fs, bodyPath, metaPath string, data []byte, meta entryMeta) error {
+	if err := fs.MkdirAll(path.Dir(bodyPath), 0o755); err != nil {
+		return err
+	}
+	if err := afero.WriteFile(fs, bodyPath, data, 0o644); err != nil {
+		return err
+	}
+	rawMeta, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, metaPath, rawMeta, 0o644)
+}
@@ -0,0 +1,207 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCache(t *testing.T, maxAge time.Duration) (*Cache, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "k6-cache-test")
+	require.NoError(t, err)
+
+	cache, err := NewCache(map[string]BucketConfig{
+		"imports": {Dir: dir, MaxAge: maxAge},
+	}, "")
+	require.NoError(t, err)
+
+	return cache, func() { _ = os.RemoveAll(dir) }
+}
+
+// TestCacheFetchServesFreshFromDisk checks that, within MaxAge, a second
+// Fetch doesn't touch the network at all.
+func TestCacheFetchServesFreshFromDisk(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	cache, cleanup := newTestCache(t, time.Hour)
+	defer cleanup()
+
+	u, err := url.Parse(srv.URL + "/module.js")
+	require.NoError(t, err)
+
+	src1, err := cache.Fetch("imports", u)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(src1.Data))
+
+	src2, err := cache.Fetch("imports", u)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(src2.Data))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&hits), "second fetch should be served from disk")
+}
+
+// TestCacheFetchRevalidates304ExtendsTTL checks that, once stale, a 304
+// response serves the existing body and refreshes FetchedAt instead of
+// re-fetching the body.
+func TestCacheFetchRevalidates304ExtendsTTL(t *testing.T) {
+	var gets, conditionalGets int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditionalGets, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&gets, 1)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	// A MaxAge of ~0 means the very next Fetch is already stale, so it
+	// exercises the revalidation path instead of the disk-hit path.
+	cache, cleanup := newTestCache(t, time.Nanosecond)
+	defer cleanup()
+
+	u, err := url.Parse(srv.URL + "/module.js")
+	require.NoError(t, err)
+
+	_, err = cache.Fetch("imports", u)
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond)
+	src, err := cache.Fetch("imports", u)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(src.Data))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&gets))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&conditionalGets))
+}
+
+// TestCacheFetchRevalidates200RefreshesBody checks that a changed response
+// (200, not 304) replaces the cached body.
+func TestCacheFetchRevalidates200RefreshesBody(t *testing.T) {
+	var version int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := atomic.LoadInt32(&version)
+		w.Header().Set("ETag", "v"+string(rune('0'+v)))
+		_, _ = w.Write([]byte("body-v" + string(rune('0'+v))))
+	}))
+	defer srv.Close()
+
+	cache, cleanup := newTestCache(t, time.Nanosecond)
+	defer cleanup()
+
+	u, err := url.Parse(srv.URL + "/module.js")
+	require.NoError(t, err)
+
+	src1, err := cache.Fetch("imports", u)
+	require.NoError(t, err)
+	assert.Equal(t, "body-v1", string(src1.Data))
+
+	atomic.StoreInt32(&version, 2)
+	time.Sleep(time.Millisecond)
+
+	src2, err := cache.Fetch("imports", u)
+	require.NoError(t, err)
+	assert.Equal(t, "body-v2", string(src2.Data))
+}
+
+// TestCacheFetchOfflineServesStale checks that, with Offline set, a stale
+// entry is served as-is rather than triggering a revalidation request.
+func TestCacheFetchOfflineServesStale(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	cache, cleanup := newTestCache(t, time.Nanosecond)
+	defer cleanup()
+
+	u, err := url.Parse(srv.URL + "/module.js")
+	require.NoError(t, err)
+
+	_, err = cache.Fetch("imports", u)
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond)
+	cache.Offline = true
+
+	src, err := cache.Fetch("imports", u)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(src.Data))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&hits), "offline fetch of a stale entry must not hit the network")
+}
+
+// TestCacheFetchOfflineMissErrors checks that Offline with nothing cached
+// fails closed with ErrOffline rather than reaching out to the network.
+func TestCacheFetchOfflineMissErrors(t *testing.T) {
+	cache, cleanup := newTestCache(t, time.Hour)
+	defer cleanup()
+	cache.Offline = true
+
+	u, err := url.Parse("https://example.invalid/module.js")
+	require.NoError(t, err)
+
+	_, err = cache.Fetch("imports", u)
+	assert.Equal(t, ErrOffline, err)
+}
+
+// TestCacheFetchDisabledBucketAlwaysLive checks that MaxAge ==
+// CacheDisabled turns the bucket into a pass-through: every Fetch hits the
+// network instead of being served from disk.
+func TestCacheFetchDisabledBucketAlwaysLive(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	cache, cleanup := newTestCache(t, CacheDisabled)
+	defer cleanup()
+
+	u, err := url.Parse(srv.URL + "/module.js")
+	require.NoError(t, err)
+
+	_, err = cache.Fetch("imports", u)
+	require.NoError(t, err)
+	_, err = cache.Fetch("imports", u)
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 2, atomic.LoadInt32(&hits))
+}
@@ -0,0 +1,235 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package loader contains the functions that resolve and fetch k6 test
+// scripts and the modules they import, whether they live on local disk or
+// are served over HTTPS.
+package loader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// fileSchemeCouldntBeLoadedMsg is returned (formatted with the offending
+// URL) when a file:// module specifier can't be found on local disk.
+const fileSchemeCouldntBeLoadedMsg = `The moduleSpecifier "%s" couldn't be found on local disk`
+
+// SourceData wraps a source file, no matter where it came from.
+type SourceData struct {
+	URL  *url.URL
+	Data []byte
+}
+
+// Dir returns the directory containing the given URL's path, with a
+// trailing slash, so further module specifiers can be joined onto it.
+func Dir(old *url.URL) *url.URL {
+	newURL := *old
+	idx := strings.LastIndexByte(old.Path, '/')
+	if idx == -1 {
+		newURL.Path = "/"
+	} else {
+		newURL.Path = old.Path[:idx+1]
+	}
+	return &newURL
+}
+
+// Resolve turns a module specifier, as it appears in an `import` or
+// `require()` in the script at pwd, into an absolute URL. Local paths are
+// resolved relative to pwd, absolute https:// URLs are passed through
+// unchanged, and bare specifiers that look like hostnames (e.g.
+// "example.com/module.js") are promoted to https:// for convenience.
+// file:// module specifiers are rejected unless pwd is itself local, so a
+// remotely loaded script can't read the filesystem of the machine running
+// the test.
+func Resolve(pwd *url.URL, moduleSpecifier string) (*url.URL, error) {
+	if moduleSpecifier == "" {
+		return nil, errors.New("local or remote path required")
+	}
+
+	if u, err := url.Parse(moduleSpecifier); err != nil {
+		return nil, err
+	} else if u.Opaque == "" {
+		switch u.Scheme {
+		case "":
+			// No scheme, handled below - either a local/relative path or a
+			// bare specifier that should be promoted to https://.
+		case "https":
+			return u, nil
+		case "oci":
+			return u, nil
+		case "file":
+			if pwd.Scheme != "file" {
+				return nil, fmt.Errorf(
+					"origin (%s) not allowed to load local file: %s", pwd, moduleSpecifier,
+				)
+			}
+			if fileSandbox != nil {
+				if err := fileSandbox.CheckPath(u.Path); err != nil {
+					return nil, err
+				}
+			}
+			return u, nil
+		default:
+			return nil, fmt.Errorf(
+				"only supported schemes for imports are file, https and oci, %s has `%s`",
+				moduleSpecifier, u.Scheme,
+			)
+		}
+	}
+
+	if strings.HasPrefix(moduleSpecifier, "/") || strings.HasPrefix(moduleSpecifier, ".") {
+		newURL := *pwd
+		if strings.HasPrefix(moduleSpecifier, "/") {
+			newURL.Path = moduleSpecifier
+		} else {
+			basePath := pwd.Path
+			if basePath == "" {
+				basePath = "/"
+			}
+			newURL.Path = path.Join(basePath, moduleSpecifier)
+		}
+		newURL.RawQuery = ""
+		newURL.Fragment = ""
+		if newURL.Scheme == "file" && fileSandbox != nil {
+			if err := fileSandbox.CheckPath(newURL.Path); err != nil {
+				return nil, err
+			}
+		}
+		return &newURL, nil
+	}
+
+	// TODO: warn that this behavior is deprecated and the module specifier
+	// should be an explicit https:// URL instead.
+	return url.Parse("https://" + moduleSpecifier)
+}
+
+// Load fetches the source of the module at moduleURL, using filesystems to
+// resolve file:// and https:// schemes to the afero.Fs that should serve
+// them. originalPath is only used for error messages, so they refer to the
+// module specifier as it was written rather than the resolved URL.
+func Load(filesystems map[string]afero.Fs, moduleURL *url.URL, originalPath string) (*SourceData, error) {
+	switch moduleURL.Scheme {
+	case "file":
+		var data []byte
+		var err error
+		if fileSandbox != nil {
+			f, openErr := fileSandbox.Open(moduleURL.Path)
+			if openErr != nil {
+				if _, ok := openErr.(*ErrImportOutsideRoot); ok {
+					return nil, openErr
+				}
+				err = openErr
+			} else {
+				defer func() { _ = f.Close() }()
+				data, err = ioutil.ReadAll(f)
+			}
+		} else {
+			data, err = afero.ReadFile(filesystems["file"], moduleURL.Path)
+		}
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf(fileSchemeCouldntBeLoadedMsg, moduleURL.String())
+			}
+			return nil, err
+		}
+		return &SourceData{URL: moduleURL, Data: data}, nil
+	case "oci":
+		return loadOCI(filesystems, moduleURL, originalPath)
+	default:
+		return loadRemote(filesystems, moduleURL, originalPath)
+	}
+}
+
+// defaultCache is the Cache loadRemote falls back to when the caller's
+// filesystems map doesn't already carry one under "https" - this is what
+// lets a caller like actionRun, which never builds its own filesystems
+// map (it only calls the opaque loadtest.Test.Load), still get caching
+// transparently for every https:// import once it's installed a Cache
+// with SetCache, the same way SetSandbox installs a file:// sandbox.
+var defaultCache *Cache
+
+// SetCache installs (or, with a nil argument, removes) the Cache
+// https:// imports transparently read through when no caller-supplied
+// filesystems map already has one installed under "https".
+func SetCache(c *Cache) {
+	defaultCache = c
+}
+
+// loadRemote fetches moduleURL over HTTPS, first trying the `_k6=1` query
+// parameter some hosts (e.g. GitHub) use to serve the raw, unrendered
+// source of a file, and falling back to the bare URL if that request
+// doesn't succeed. If filesystems["https"] is a *Cache.Fs (installed by
+// whoever built the filesystems map from the test's `caches` config), or
+// failing that a Cache has been installed process-wide with SetCache, the
+// request is transparently served through it instead, which may resolve
+// entirely from disk.
+func loadRemote(filesystems map[string]afero.Fs, moduleURL *url.URL, originalPath string) (*SourceData, error) {
+	if cfs, ok := filesystems["https"].(*cacheFs); ok {
+		data, err := afero.ReadFile(cfs, moduleURL.String())
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load %s: %s", originalPath, err)
+		}
+		return &SourceData{URL: moduleURL, Data: data}, nil
+	}
+	if defaultCache != nil {
+		src, err := defaultCache.Fetch("imports", moduleURL)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load %s: %s", originalPath, err)
+		}
+		return src, nil
+	}
+
+	k6URL := *moduleURL
+	q := k6URL.Query()
+	q.Set("_k6", "1")
+	k6URL.RawQuery = q.Encode()
+
+	data, err := fetch(k6URL.String())
+	if err != nil {
+		data, err = fetch(moduleURL.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load %s: %s", originalPath, err)
+	}
+
+	return &SourceData{URL: moduleURL, Data: data}, nil
+}
+
+func fetch(u string) ([]byte, error) {
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("unexpected status %d for %s", resp.StatusCode, u)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -68,14 +68,14 @@ func TestResolve(t *testing.T) {
 			moduleSpecifier := "ws://example.com/html"
 			_, err := Resolve(root, moduleSpecifier)
 			assert.EqualError(t, err,
-				"only supported schemes for imports are file and https, "+moduleSpecifier+" has `ws`")
+				"only supported schemes for imports are file, https and oci, "+moduleSpecifier+" has `ws`")
 		})
 
 		t.Run("HTTP", func(t *testing.T) {
 			moduleSpecifier := "http://example.com/html"
 			_, err := Resolve(root, moduleSpecifier)
 			assert.EqualError(t, err,
-				"only supported schemes for imports are file and https, "+moduleSpecifier+" has `http`")
+				"only supported schemes for imports are file, https and oci, "+moduleSpecifier+" has `http`")
 		})
 	})
 
@@ -0,0 +1,502 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"golang.org/x/sync/singleflight"
+)
+
+// BundleMediaType is the media type k6 looks for among an OCI manifest's
+// layers when resolving an oci:// import; it's what `k6 bundle push`
+// writes layers as.
+const BundleMediaType = "application/vnd.k6.bundle.v1.tar+gzip"
+
+// EntrypointAnnotation is the manifest annotation a bundle can set to pick
+// a default script path when an oci:// reference has no `#fragment`; it's
+// what `k6 bundle push` writes when given --entrypoint.
+const EntrypointAnnotation = "io.k6.bundle.entrypoint"
+
+// ociManifest is the subset of the OCI image manifest schema k6 cares
+// about: https://github.com/opencontainers/image-spec/blob/main/manifest.md
+type ociManifest struct {
+	Layers      []ociDescriptor   `json:"layers"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// ociRef is a parsed oci://registry/repo:tag[#path] reference.
+type ociRef struct {
+	Registry string
+	Repo     string
+	Tag      string
+	Path     string // fragment, e.g. "path/in/bundle.js"
+}
+
+// parseOCIRef splits an oci:// URL into its registry/repo/tag/path parts.
+func parseOCIRef(u *url.URL) (ociRef, error) {
+	repo := strings.TrimPrefix(u.Path, "/")
+	tag := "latest"
+	if idx := strings.LastIndexByte(repo, ':'); idx != -1 {
+		tag = repo[idx+1:]
+		repo = repo[:idx]
+	}
+	if u.Host == "" || repo == "" {
+		return ociRef{}, fmt.Errorf("invalid oci reference %q, want oci://registry/repo:tag", u)
+	}
+	return ociRef{Registry: u.Host, Repo: repo, Tag: tag, Path: u.Fragment}, nil
+}
+
+// ociBundles caches extracted bundles by manifest digest, so repeated loads
+// against the same tag within one process only extract once. Across
+// processes, extractOCIBundle itself persists to ociCacheRoot keyed by the
+// same digest, so a cold ociBundles map (a fresh `k6 run`) still skips the
+// registry fetch and tar extraction for a digest a previous run already
+// completed. It's a sync.Map, and extraction itself is deduplicated through
+// ociSF, because loadOCI is called concurrently by PrefetchGraph's worker
+// pool - without both, two goroutines resolving the same digest at once
+// would race on a plain map and could each extract the bundle.
+var (
+	ociBundles sync.Map // digest (string) -> afero.Fs
+	ociSF      singleflight.Group
+
+	// filesystemsMu guards writes to the caller-supplied filesystems map
+	// from loadOCI's concurrent callers; Load's file/https paths only
+	// ever read it, so a single mutex here is enough to make every write
+	// to it safe.
+	filesystemsMu sync.Mutex
+)
+
+// loadOCI resolves an oci://registry/repo:tag[#path] reference: it fetches
+// the manifest, downloads and extracts the first layer with
+// BundleMediaType into a per-digest afero.Fs mounted under
+// filesystems["oci"], and returns the file named by the reference's
+// fragment (or the manifest's entrypoint annotation, if there's no
+// fragment).
+func loadOCI(filesystems map[string]afero.Fs, moduleURL *url.URL, originalPath string) (*SourceData, error) {
+	ref, err := parseOCIRef(moduleURL)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, digest, err := fetchOCIManifest(ref)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load %s: %s", originalPath, err)
+	}
+
+	v, err, _ := ociSF.Do(digest, func() (interface{}, error) {
+		if fs, ok := ociBundles.Load(digest); ok {
+			return fs, nil
+		}
+		fs, err := extractOCIBundle(ref, manifest, digest)
+		if err != nil {
+			return nil, err
+		}
+		ociBundles.Store(digest, fs)
+		return fs, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load %s: %s", originalPath, err)
+	}
+	bundleFs := v.(afero.Fs)
+
+	filesystemsMu.Lock()
+	filesystems["oci"] = bundleFs
+	filesystemsMu.Unlock()
+
+	entrypoint := ref.Path
+	if entrypoint == "" {
+		entrypoint = manifest.Annotations[EntrypointAnnotation]
+	}
+	if entrypoint == "" {
+		return nil, fmt.Errorf("%s has no #fragment and the bundle declares no entrypoint", originalPath)
+	}
+
+	data, err := afero.ReadFile(bundleFs, entrypoint)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load %s from oci bundle: %s", entrypoint, err)
+	}
+	return &SourceData{URL: moduleURL, Data: data}, nil
+}
+
+// fetchOCIManifest issues the standard registry v2 manifest request,
+// authenticating with the docker config.json or OCI_AUTH env var the same
+// way `docker pull` would (falling back to the registry's bearer-token
+// challenge, via DoRegistryRequest, when that's what the registry asks
+// for instead).
+func fetchOCIManifest(ref ociRef) (ociManifest, string, error) {
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repo, ref.Tag)
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return ociManifest{}, "", err
+	}
+	req.Header.Set("Accept", "application/vnd.oci.image.manifest.v1+json")
+
+	resp, err := DoRegistryRequest(req, ref.Registry)
+	if err != nil {
+		return ociManifest{}, "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= 400 {
+		return ociManifest{}, "", fmt.Errorf("registry returned %d for %s", resp.StatusCode, manifestURL)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ociManifest{}, "", err
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return ociManifest{}, "", err
+	}
+	return manifest, manifestDigest(resp, body), nil
+}
+
+// manifestDigest returns the digest to key the extracted-bundle cache on.
+// Docker-Content-Digest is the registry's own word on the manifest's
+// digest, but not every OCI-compliant registry or proxy reliably sets it;
+// when it's absent, fall back to the layer digest (part of the manifest
+// body itself, so always present), and only as a last resort hash the raw
+// manifest bytes. Without a real fallback, every reference whose registry
+// omits the header would collide on the same empty cache key.
+func manifestDigest(resp *http.Response, body []byte) string {
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(body, &manifest); err == nil {
+		for _, layer := range manifest.Layers {
+			if layer.MediaType == BundleMediaType && layer.Digest != "" {
+				return layer.Digest
+			}
+		}
+	}
+
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Auth returns the Authorization header value for registry, read from
+// the OCI_AUTH env var (a ready-made "Basic ..." or "Bearer ..." value) or,
+// failing that, the docker config.json credential store. It's exported so
+// `k6 bundle push` authenticates against the same registries the same way
+// oci:// imports do.
+func Auth(registry string) string {
+	if auth := os.Getenv("OCI_AUTH"); auth != "" {
+		return auth
+	}
+	return dockerConfigAuth(registry)
+}
+
+// bearerChallenge is a parsed `WWW-Authenticate: Bearer ...` header, the
+// standard distribution-spec token challenge real registries (Docker Hub,
+// GHCR, ECR, GCR) issue on a 401 - even for anonymous pulls - instead of
+// accepting a static credential directly.
+// https://distribution.github.io/distribution/spec/auth/token/
+type bearerChallenge struct {
+	Realm, Service, Scope string
+}
+
+// parseBearerChallenge parses a WWW-Authenticate header of the form
+// `Bearer realm="https://auth.example.com/token",service="...",scope="..."`.
+// ok is false if header isn't a Bearer challenge (e.g. a registry that
+// only ever does static auth and never challenges at all).
+func parseBearerChallenge(header string) (challenge bearerChallenge, ok bool) {
+	if !strings.HasPrefix(header, "Bearer ") {
+		return bearerChallenge{}, false
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(header, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.Trim(kv[1], `"`)
+		switch kv[0] {
+		case "realm":
+			challenge.Realm = value
+		case "service":
+			challenge.Service = value
+		case "scope":
+			challenge.Scope = value
+		}
+	}
+	return challenge, challenge.Realm != ""
+}
+
+// exchangeBearerToken fetches a scoped token from challenge's realm, the
+// second half of the distribution-spec token flow. static, if it's a
+// "Basic ..." credential from Auth, is forwarded to the token endpoint so
+// a private repo (not just an anonymous pull) can mint a token too.
+func exchangeBearerToken(challenge bearerChallenge, static string) (string, error) {
+	tokenURL, err := url.Parse(challenge.Realm)
+	if err != nil {
+		return "", err
+	}
+	q := tokenURL.Query()
+	if challenge.Service != "" {
+		q.Set("service", challenge.Service)
+	}
+	if challenge.Scope != "" {
+		q.Set("scope", challenge.Scope)
+	}
+	tokenURL.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(static, "Basic ") {
+		req.Header.Set("Authorization", static)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("token endpoint %s returned %d", tokenURL, resp.StatusCode)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// DoRegistryRequest sends req against registry, first trying whatever
+// static credential Auth(registry) provides (if any), and - since every
+// registry this package targets (Docker Hub, GHCR, ECR, GCR) challenges
+// even anonymous pulls with a 401 + WWW-Authenticate: Bearer rather than
+// accepting that credential directly - exchanging the challenge for a
+// scoped token and retrying once when that happens. req must have been
+// built with a body type http.NewRequest knows how to replay (e.g.
+// bytes.NewReader), so GetBody is set, if it carries one at all. It's
+// exported so `k6 bundle push`'s write requests authenticate the same way
+// oci:// imports do.
+func DoRegistryRequest(req *http.Request, registry string) (*http.Response, error) {
+	if auth := Auth(registry); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge, ok := parseBearerChallenge(resp.Header.Get("WWW-Authenticate"))
+	_ = resp.Body.Close()
+	if !ok {
+		return resp, nil
+	}
+
+	token, err := exchangeBearerToken(challenge, req.Header.Get("Authorization"))
+	if err != nil {
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if body, bodyErr := req.GetBody(); bodyErr == nil {
+			retry.Body = body
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(retry)
+}
+
+// dockerConfigAuth reads ~/.docker/config.json and returns a "Basic ..."
+// Authorization header built from the base64 auth string stored there for
+// registry, if any.
+func dockerConfigAuth(registry string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	data, err := ioutil.ReadFile(home + "/.docker/config.json")
+	if err != nil {
+		return ""
+	}
+
+	var cfg struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return ""
+	}
+	if entry, ok := cfg.Auths[registry]; ok && entry.Auth != "" {
+		return "Basic " + entry.Auth
+	}
+	return ""
+}
+
+// ociBundleCompleteMarker is written into a digest's cache directory once
+// extraction has finished, so a directory left behind by a process that
+// died mid-extraction isn't mistaken for a complete, reusable bundle.
+const ociBundleCompleteMarker = ".k6-complete"
+
+// ociCacheRoot is the on-disk directory extracted bundles are persisted
+// under, so a digest already extracted by a previous `k6 run` doesn't cost
+// another registry fetch and tar extraction just because ociBundles - the
+// in-memory, per-process cache - started out empty again.
+func ociCacheRoot() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "k6", "oci"), nil
+}
+
+// digestCacheDir returns the on-disk directory digest's bundle is (or
+// would be) extracted into, and whether it already holds a complete
+// extraction. digest is OCI's "sha256:<hex>" form; the colon is replaced
+// since it isn't a valid path character on Windows.
+func digestCacheDir(digest string) (dir string, complete bool, err error) {
+	root, err := ociCacheRoot()
+	if err != nil {
+		return "", false, err
+	}
+	dir = filepath.Join(root, strings.Replace(digest, ":", "_", 1))
+	_, statErr := os.Stat(filepath.Join(dir, ociBundleCompleteMarker))
+	return dir, statErr == nil, nil
+}
+
+// extractOCIBundle returns digest's bundle as an afero.Fs, preferring an
+// already-complete on-disk extraction under ociCacheRoot over downloading
+// the layer again. On a cache miss, it downloads the manifest's
+// BundleMediaType layer and extracts it into that same on-disk directory
+// (marking it complete once done) so the next process to ask for digest
+// can skip straight to the cache; if the cache directory can't be
+// resolved or created, it falls back to a fresh in-memory filesystem
+// instead of failing the load outright.
+func extractOCIBundle(ref ociRef, manifest ociManifest, digest string) (afero.Fs, error) {
+	dir, complete, err := digestCacheDir(digest)
+	if err == nil && complete {
+		return afero.NewBasePathFs(afero.NewOsFs(), dir), nil
+	}
+
+	var layer *ociDescriptor
+	for i := range manifest.Layers {
+		if manifest.Layers[i].MediaType == BundleMediaType {
+			layer = &manifest.Layers[i]
+			break
+		}
+	}
+	if layer == nil {
+		return nil, fmt.Errorf("manifest for %s/%s:%s has no %s layer", ref.Registry, ref.Repo, ref.Tag, BundleMediaType)
+	}
+
+	blobURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", ref.Registry, ref.Repo, layer.Digest)
+	req, err := http.NewRequest(http.MethodGet, blobURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := DoRegistryRequest(req, ref.Registry)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("registry returned %d for %s", resp.StatusCode, blobURL)
+	}
+
+	gzr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "not a gzip-compressed bundle")
+	}
+	defer func() { _ = gzr.Close() }()
+
+	fs, persisting := bundleExtractFs(dir)
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading bundle tar")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := afero.WriteReader(fs, hdr.Name, tr); err != nil {
+			return nil, errors.Wrapf(err, "extracting %s", hdr.Name)
+		}
+	}
+
+	if persisting {
+		if err := afero.WriteFile(fs, ociBundleCompleteMarker, nil, 0o644); err != nil {
+			return nil, errors.Wrap(err, "marking bundle cache complete")
+		}
+	}
+	return fs, nil
+}
+
+// bundleExtractFs returns the afero.Fs extractOCIBundle should extract a
+// fresh download into: dir on disk if it can be created, or a bare
+// in-memory filesystem if dir is empty (ociCacheRoot couldn't be resolved)
+// or isn't writable. persisting reports which one it picked, since only a
+// disk-backed extraction is worth marking complete for later runs to find.
+func bundleExtractFs(dir string) (fs afero.Fs, persisting bool) {
+	if dir == "" {
+		return afero.NewMemMapFs(), false
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return afero.NewMemMapFs(), false
+	}
+	return afero.NewBasePathFs(afero.NewOsFs(), dir), true
+}
@@ -0,0 +1,292 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// schemeDowngradeTransport forces every request's scheme to http, so
+// production code that always dials "https://<registry>" can be pointed
+// at a plain httptest.Server.
+type schemeDowngradeTransport struct{ rt http.RoundTripper }
+
+func (t schemeDowngradeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	return t.rt.RoundTrip(req)
+}
+
+func buildTestLayer(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(content)), Mode: 0o644}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+	return buf.Bytes()
+}
+
+// useTempOCICache points ociCacheRoot at a fresh temporary directory until
+// the returned cleanup runs, so a bundle that an earlier run already
+// extracted into the user's cache directory can't satisfy the test without
+// a blob fetch.
+func useTempOCICache(t *testing.T) func() {
+	t.Helper()
+	cacheHome, err := ioutil.TempDir("", "k6-oci-cache-test")
+	require.NoError(t, err)
+	origXDG, hadXDG := os.LookupEnv("XDG_CACHE_HOME")
+	require.NoError(t, os.Setenv("XDG_CACHE_HOME", cacheHome))
+	return func() {
+		if hadXDG {
+			_ = os.Setenv("XDG_CACHE_HOME", origXDG)
+		} else {
+			_ = os.Unsetenv("XDG_CACHE_HOME")
+		}
+		_ = os.RemoveAll(cacheHome)
+	}
+}
+
+// TestLoadOCIConcurrentDedup resolves the same oci:// reference from many
+// goroutines at once, the way PrefetchGraph's worker pool does. Before the
+// ociBundles/filesystems map accesses in loadOCI were guarded, this
+// reliably either crashed the test binary with a concurrent map write or
+// extracted the bundle more than once.
+func TestLoadOCIConcurrentDedup(t *testing.T) {
+	const digest = "sha256:deadbeef"
+	layer := buildTestLayer(t, map[string]string{"index.js": "export default 1;"})
+	defer useTempOCICache(t)()
+
+	var blobFetches int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/team/suite/manifests/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", digest)
+		_ = json.NewEncoder(w).Encode(ociManifest{
+			Layers: []ociDescriptor{{MediaType: BundleMediaType, Digest: digest, Size: int64(len(layer))}},
+		})
+	})
+	mux.HandleFunc("/v2/team/suite/blobs/"+digest, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&blobFetches, 1)
+		_, _ = w.Write(layer)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	origTransport := http.DefaultTransport
+	http.DefaultTransport = schemeDowngradeTransport{rt: origTransport}
+	defer func() { http.DefaultTransport = origTransport }()
+
+	moduleURL, err := url.Parse(fmt.Sprintf("oci://%s/team/suite:v1#index.js", srv.Listener.Addr().String()))
+	require.NoError(t, err)
+
+	filesystems := map[string]afero.Fs{}
+	const workers = 16
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			src, err := loadOCI(filesystems, moduleURL, moduleURL.String())
+			if err == nil {
+				assert.Equal(t, "export default 1;", string(src.Data))
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&blobFetches), "bundle should only be extracted/fetched once")
+}
+
+// TestFetchOCIManifestBearerChallenge points fetchOCIManifest at a server
+// that behaves like a real registry: it 401s the first request with a
+// WWW-Authenticate: Bearer challenge instead of accepting Auth's static
+// credential, then only serves the manifest once retried with a token
+// minted by the challenge's realm. Before DoRegistryRequest existed, the
+// static-auth-only request had no way to get past the 401.
+func TestFetchOCIManifestBearerChallenge(t *testing.T) {
+	const digest = "sha256:deadbeef"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "registry.example.test", r.URL.Query().Get("service"))
+		assert.Equal(t, "repository:team/suite:pull", r.URL.Query().Get("scope"))
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "test-token"})
+	})
+	mux.HandleFunc("/v2/team/suite/manifests/v1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="http://`+r.Host+`/token",service="registry.example.test",scope="repository:team/suite:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		_ = json.NewEncoder(w).Encode(ociManifest{
+			Layers: []ociDescriptor{{MediaType: BundleMediaType, Digest: digest, Size: 1}},
+		})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	origTransport := http.DefaultTransport
+	http.DefaultTransport = schemeDowngradeTransport{rt: origTransport}
+	defer func() { http.DefaultTransport = origTransport }()
+
+	manifest, gotDigest, err := fetchOCIManifest(ociRef{
+		Registry: srv.Listener.Addr().String(),
+		Repo:     "team/suite",
+		Tag:      "v1",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, digest, gotDigest)
+	require.Len(t, manifest.Layers, 1)
+	assert.Equal(t, digest, manifest.Layers[0].Digest)
+}
+
+// TestExtractOCIBundlePersistsAcrossProcesses checks that a bundle
+// extraction survives the in-memory ociBundles map being reset - standing
+// in for a second, separate `k6 run` process - by serving the on-disk
+// cache extractOCIBundle wrote on the first call instead of re-fetching
+// the blob from the registry.
+func TestExtractOCIBundlePersistsAcrossProcesses(t *testing.T) {
+	cacheHome, err := ioutil.TempDir("", "k6-oci-cache-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(cacheHome) }()
+	origXDG, hadXDG := os.LookupEnv("XDG_CACHE_HOME")
+	require.NoError(t, os.Setenv("XDG_CACHE_HOME", cacheHome))
+	defer func() {
+		if hadXDG {
+			_ = os.Setenv("XDG_CACHE_HOME", origXDG)
+		} else {
+			_ = os.Unsetenv("XDG_CACHE_HOME")
+		}
+	}()
+
+	const digest = "sha256:f00dfeed"
+	layer := buildTestLayer(t, map[string]string{"index.js": "export default 1;"})
+
+	var blobFetches int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/team/suite/manifests/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", digest)
+		_ = json.NewEncoder(w).Encode(ociManifest{
+			Layers: []ociDescriptor{{MediaType: BundleMediaType, Digest: digest, Size: int64(len(layer))}},
+		})
+	})
+	mux.HandleFunc("/v2/team/suite/blobs/"+digest, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&blobFetches, 1)
+		_, _ = w.Write(layer)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	origTransport := http.DefaultTransport
+	http.DefaultTransport = schemeDowngradeTransport{rt: origTransport}
+	defer func() { http.DefaultTransport = origTransport }()
+
+	moduleURL, err := url.Parse(fmt.Sprintf("oci://%s/team/suite:v1#index.js", srv.Listener.Addr().String()))
+	require.NoError(t, err)
+
+	src, err := loadOCI(map[string]afero.Fs{}, moduleURL, moduleURL.String())
+	require.NoError(t, err)
+	assert.Equal(t, "export default 1;", string(src.Data))
+
+	ociBundles.Delete(digest)
+
+	src, err = loadOCI(map[string]afero.Fs{}, moduleURL, moduleURL.String())
+	require.NoError(t, err)
+	assert.Equal(t, "export default 1;", string(src.Data))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&blobFetches), "second load should be served from the on-disk cache, not re-fetched")
+}
+
+// TestLoadOCIMissingDigestHeaderDoesNotCollide resolves two different
+// repo/tag references whose manifests both omit Docker-Content-Digest.
+// Before manifestDigest fell back to the layer digest, both would collapse
+// onto the same "" cache key and the second load would silently return the
+// first bundle's content instead of its own.
+func TestLoadOCIMissingDigestHeaderDoesNotCollide(t *testing.T) {
+	layerA := buildTestLayer(t, map[string]string{"index.js": "export default 'a';"})
+	layerB := buildTestLayer(t, map[string]string{"index.js": "export default 'b';"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/teamA/suite/manifests/v1", func(w http.ResponseWriter, r *http.Request) {
+		// Deliberately no Docker-Content-Digest header.
+		_ = json.NewEncoder(w).Encode(ociManifest{
+			Layers: []ociDescriptor{{MediaType: BundleMediaType, Digest: "sha256:aaaa", Size: int64(len(layerA))}},
+		})
+	})
+	mux.HandleFunc("/v2/teamB/suite/manifests/v1", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(ociManifest{
+			Layers: []ociDescriptor{{MediaType: BundleMediaType, Digest: "sha256:bbbb", Size: int64(len(layerB))}},
+		})
+	})
+	mux.HandleFunc("/v2/teamA/suite/blobs/sha256:aaaa", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(layerA)
+	})
+	mux.HandleFunc("/v2/teamB/suite/blobs/sha256:bbbb", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(layerB)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	origTransport := http.DefaultTransport
+	http.DefaultTransport = schemeDowngradeTransport{rt: origTransport}
+	defer func() { http.DefaultTransport = origTransport }()
+
+	registry := srv.Listener.Addr().String()
+	urlA, err := url.Parse(fmt.Sprintf("oci://%s/teamA/suite:v1#index.js", registry))
+	require.NoError(t, err)
+	urlB, err := url.Parse(fmt.Sprintf("oci://%s/teamB/suite:v1#index.js", registry))
+	require.NoError(t, err)
+
+	srcA, err := loadOCI(map[string]afero.Fs{}, urlA, urlA.String())
+	require.NoError(t, err)
+	srcB, err := loadOCI(map[string]afero.Fs{}, urlB, urlB.String())
+	require.NoError(t, err)
+
+	assert.Equal(t, "export default 'a';", string(srcA.Data))
+	assert.Equal(t, "export default 'b';", string(srcB.Data))
+}
@@ -0,0 +1,185 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"net/url"
+	"regexp"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/spf13/afero"
+	"golang.org/x/sync/singleflight"
+)
+
+// importFromRe and requireRe are a deliberately loose, regex-based scan
+// for `import`/`require` specifiers: good enough to discover the import
+// graph ahead of the compiler actually running, without needing a full JS
+// parser.
+var (
+	importFromRe = regexp.MustCompile(`import\s+(?:[^'";]*?\sfrom\s*)?['"]([^'"]+)['"]`)
+	requireRe    = regexp.MustCompile(`require\(\s*['"]([^'"]+)['"]\s*\)`)
+)
+
+// scanSpecifiers returns every module specifier statically discoverable
+// in src's import and require() statements, in source order.
+func scanSpecifiers(src []byte) []string {
+	var specs []string
+	for _, m := range importFromRe.FindAllSubmatch(src, -1) {
+		specs = append(specs, string(m[1]))
+	}
+	for _, m := range requireRe.FindAllSubmatch(src, -1) {
+		specs = append(specs, string(m[1]))
+	}
+	return specs
+}
+
+// PrefetchProgress is sent on PrefetchOpts.Progress as the prefetch walk
+// discovers and completes imports.
+type PrefetchProgress struct {
+	Discovered int64
+	Completed  int64
+	Bytes      int64
+}
+
+// PrefetchOpts configures PrefetchGraph.
+type PrefetchOpts struct {
+	// Concurrency bounds the worker pool fetching imports; it defaults to
+	// runtime.GOMAXPROCS(0) when <= 0.
+	Concurrency int
+	// Progress, if non-nil, receives a PrefetchProgress after every
+	// discovery and completion. Sends are non-blocking: a slow or absent
+	// consumer drops updates rather than stalling the prefetch.
+	Progress chan<- PrefetchProgress
+}
+
+// PrefetchGraph statically scans src for import/require specifiers, walks
+// the transitive closure of everything it (and everything it imports)
+// pulls in, and fetches each unique specifier through a bounded worker
+// pool, so a script with many cold imports pays for them in parallel
+// instead of one compiler-driven round-trip at a time. Diamond imports -
+// the same URL reached via two different paths - are deduplicated by
+// resolved URL (a seen set, with each fetch run through a
+// singleflight.Group keyed the same way), so each one is only fetched once
+// no matter how many places reference it.
+//
+// Errors from individual imports don't abort the walk; they're collected
+// into a single returned multierror so a script with several broken
+// imports reports all of them in one run instead of just the first.
+// Every fetch goes through Load itself, so when a Cache is installed
+// (under filesystems["https"] or with SetCache) the compiler's subsequent,
+// serial Load calls for the same specifiers are served from the now-warm
+// cache. Without a Cache, fetched https:// sources are not kept anywhere.
+func PrefetchGraph(root *url.URL, src []byte, filesystems map[string]afero.Fs, opts PrefetchOpts) error {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	var (
+		sf   singleflight.Group
+		mu   sync.Mutex
+		seen = map[string]bool{}
+		merr *multierror.Error
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, concurrency)
+
+		discovered int64
+		completed  int64
+		bytesTotal int64
+	)
+
+	report := func() {
+		if opts.Progress == nil {
+			return
+		}
+		select {
+		case opts.Progress <- PrefetchProgress{
+			Discovered: atomic.LoadInt64(&discovered),
+			Completed:  atomic.LoadInt64(&completed),
+			Bytes:      atomic.LoadInt64(&bytesTotal),
+		}:
+		default:
+		}
+	}
+
+	addErr := func(err error) {
+		mu.Lock()
+		merr = multierror.Append(merr, err)
+		mu.Unlock()
+	}
+
+	var visit func(pwd *url.URL, source []byte)
+	visit = func(pwd *url.URL, source []byte) {
+		for _, spec := range scanSpecifiers(source) {
+			u, err := Resolve(pwd, spec)
+			if err != nil {
+				addErr(err)
+				continue
+			}
+
+			key := u.String()
+			mu.Lock()
+			if seen[key] {
+				mu.Unlock()
+				continue
+			}
+			seen[key] = true
+			mu.Unlock()
+			atomic.AddInt64(&discovered, 1)
+			report()
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(u *url.URL, spec string) {
+				defer wg.Done()
+
+				v, err, _ := sf.Do(key, func() (interface{}, error) {
+					return Load(filesystems, u, spec)
+				})
+				atomic.AddInt64(&completed, 1)
+				// Release the slot before recursing into this module's
+				// own imports: visit may need the semaphore itself, and
+				// since it runs inline in this same goroutine rather than
+				// a fresh one, holding the slot across the recursive call
+				// would deadlock any chain deeper than Concurrency.
+				<-sem
+				if err != nil {
+					addErr(err)
+					report()
+					return
+				}
+
+				sd := v.(*SourceData)
+				atomic.AddInt64(&bytesTotal, int64(len(sd.Data)))
+				report()
+				visit(Dir(u), sd.Data)
+			}(u, spec)
+		}
+	}
+
+	visit(root, src)
+	wg.Wait()
+
+	return merr.ErrorOrNil()
+}
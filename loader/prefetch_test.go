@@ -0,0 +1,167 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPrefetchGraphDedupesDiamondImports walks a root that imports two
+// siblings which both import the same shared module. The worker pool
+// should fetch "shared.js" exactly once, since PrefetchGraph dedupes by
+// resolved URL, no matter how many discovery paths reach it.
+func TestPrefetchGraphDedupesDiamondImports(t *testing.T) {
+	var sharedFetches int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a.js", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `import "./shared.js";`)
+	})
+	mux.HandleFunc("/b.js", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `import "./shared.js";`)
+	})
+	mux.HandleFunc("/shared.js", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sharedFetches, 1)
+		_, _ = fmt.Fprint(w, `export const x = 1;`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	origTransport := http.DefaultTransport
+	http.DefaultTransport = schemeDowngradeTransport{rt: origTransport}
+	defer func() { http.DefaultTransport = origTransport }()
+
+	root, err := url.Parse("https://" + srv.Listener.Addr().String() + "/")
+	require.NoError(t, err)
+
+	filesystems := map[string]afero.Fs{"https": afero.NewMemMapFs()}
+	src := []byte(`import "./a.js"; import "./b.js";`)
+
+	err = PrefetchGraph(root, src, filesystems, PrefetchOpts{Concurrency: 4})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&sharedFetches))
+}
+
+// TestPrefetchGraphDeepChainSingleWorker walks a 4-level import chain
+// (a -> b -> c -> d) with Concurrency: 1, the default on a single-CPU CI
+// container. A worker that recurses into its own import's children while
+// still holding its semaphore slot would deadlock here, since the child
+// fetch can never acquire the only slot; PrefetchGraph must release the
+// slot before recursing.
+func TestPrefetchGraphDeepChainSingleWorker(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a.js", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `import "./b.js";`)
+	})
+	mux.HandleFunc("/b.js", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `import "./c.js";`)
+	})
+	mux.HandleFunc("/c.js", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `import "./d.js";`)
+	})
+	mux.HandleFunc("/d.js", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `export const x = 1;`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	origTransport := http.DefaultTransport
+	http.DefaultTransport = schemeDowngradeTransport{rt: origTransport}
+	defer func() { http.DefaultTransport = origTransport }()
+
+	root, err := url.Parse("https://" + srv.Listener.Addr().String() + "/")
+	require.NoError(t, err)
+
+	filesystems := map[string]afero.Fs{"https": afero.NewMemMapFs()}
+	src := []byte(`import "./a.js";`)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- PrefetchGraph(root, src, filesystems, PrefetchOpts{Concurrency: 1})
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("PrefetchGraph deadlocked on a multi-level import chain with Concurrency: 1")
+	}
+}
+
+// TestPrefetchGraphOCIConcurrency exercises PrefetchGraph itself (rather
+// than calling loadOCI directly) against a root that imports the same
+// oci:// reference twice, reproducing the conditions that used to trigger
+// a concurrent map write (and, even when it didn't crash, a duplicate
+// bundle extraction) in loadOCI.
+func TestPrefetchGraphOCIConcurrency(t *testing.T) {
+	const digest = "sha256:cafef00d"
+	layer := buildTestLayer(t, map[string]string{"index.js": "export default 2;"})
+	defer useTempOCICache(t)()
+
+	var blobFetches int32
+	manifestHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", digest)
+		_ = json.NewEncoder(w).Encode(ociManifest{
+			Layers: []ociDescriptor{{MediaType: BundleMediaType, Digest: digest, Size: int64(len(layer))}},
+		})
+	}
+	mux := http.NewServeMux()
+	// Two distinct tags resolving to the same manifest digest, so the two
+	// require()s below reach loadOCI as two different (and thus
+	// not-deduped-by-PrefetchGraph) URLs that nonetheless race on the same
+	// ociBundles/ociSF entry.
+	mux.HandleFunc("/v2/team/suite/manifests/v1", manifestHandler)
+	mux.HandleFunc("/v2/team/suite/manifests/v1-alias", manifestHandler)
+	mux.HandleFunc("/v2/team/suite/blobs/"+digest, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&blobFetches, 1)
+		_, _ = w.Write(layer)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	origTransport := http.DefaultTransport
+	http.DefaultTransport = schemeDowngradeTransport{rt: origTransport}
+	defer func() { http.DefaultTransport = origTransport }()
+
+	registry := srv.Listener.Addr().String()
+	root, err := url.Parse("file:///")
+	require.NoError(t, err)
+
+	src := []byte(fmt.Sprintf(
+		`require('oci://%s/team/suite:v1#index.js'); require('oci://%s/team/suite:v1-alias#index.js');`,
+		registry, registry,
+	))
+
+	filesystems := map[string]afero.Fs{}
+	err = PrefetchGraph(root, src, filesystems, PrefetchOpts{Concurrency: 8})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&blobFetches))
+}
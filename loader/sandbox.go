@@ -0,0 +1,147 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// ErrImportOutsideRoot is returned by Resolve and Load when a file://
+// module specifier resolves to a path outside the configured import root
+// (and outside its allowlist), whether via "..", an absolute path, or a
+// symlink.
+type ErrImportOutsideRoot struct {
+	Path string
+	Root string
+}
+
+func (e *ErrImportOutsideRoot) Error() string {
+	return fmt.Sprintf("import path %q is outside the import root %q", e.Path, e.Root)
+}
+
+// Sandbox chroots file:// imports to a directory, plus an optional
+// allowlist of additional directories (e.g. a shared fixtures dir), using
+// afero.BasePathFs so a script can't read anything outside of them -
+// whether by "..", an absolute path, or a symlink that points outside.
+type Sandbox struct {
+	root    string
+	allow   []string
+	rootFs  afero.Fs
+	allowFs []afero.Fs
+}
+
+// NewSandbox builds a Sandbox rooted at root, with additional directories
+// in allow also reachable by file:// imports.
+func NewSandbox(root string, allow ...string) (*Sandbox, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	sb := &Sandbox{root: filepath.Clean(root), rootFs: afero.NewBasePathFs(afero.NewOsFs(), root)}
+	for _, dir := range allow {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Clean(dir)
+		sb.allow = append(sb.allow, dir)
+		sb.allowFs = append(sb.allowFs, afero.NewBasePathFs(afero.NewOsFs(), dir))
+	}
+	return sb, nil
+}
+
+// contain resolves path (already made absolute) against whichever of the
+// sandbox's roots contains it, following symlinks so a link inside the
+// root can't be used to point outside of it. It returns the matching
+// root's afero.Fs and the path relative to that root, as afero.BasePathFs
+// expects.
+func (sb *Sandbox) contain(absPath string) (afero.Fs, string, error) {
+	resolved := absPath
+	if real, err := filepath.EvalSymlinks(absPath); err == nil {
+		resolved = real
+	}
+
+	roots := append([]string{sb.root}, sb.allow...)
+	fss := append([]afero.Fs{sb.rootFs}, sb.allowFs...)
+	for i, root := range roots {
+		if rel, ok := relWithin(root, resolved); ok {
+			return fss[i], rel, nil
+		}
+	}
+	return nil, "", &ErrImportOutsideRoot{Path: absPath, Root: sb.root}
+}
+
+// relWithin returns path relative to root, and whether path is root or a
+// descendant of it.
+func relWithin(root, path string) (string, bool) {
+	if path == root {
+		return ".", true
+	}
+	prefix := root
+	if !strings.HasSuffix(prefix, string(os.PathSeparator)) {
+		prefix += string(os.PathSeparator)
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(path, prefix), true
+}
+
+// CheckPath does the same containment check as Open, minus the symlink
+// resolution and the actual filesystem access - it's what Resolve uses to
+// reject an escaping "../" or absolute path before the file even needs to
+// exist.
+func (sb *Sandbox) CheckPath(absPath string) error {
+	roots := append([]string{sb.root}, sb.allow...)
+	for _, root := range roots {
+		if _, ok := relWithin(root, filepath.Clean(absPath)); ok {
+			return nil
+		}
+	}
+	return &ErrImportOutsideRoot{Path: absPath, Root: sb.root}
+}
+
+// Open resolves name (an absolute OS path) through the sandbox and opens
+// it, returning ErrImportOutsideRoot if it falls outside every configured
+// root.
+func (sb *Sandbox) Open(name string) (afero.File, error) {
+	fs, rel, err := sb.contain(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Open(rel)
+}
+
+// fileSandbox is the Sandbox Resolve and Load enforce file:// imports
+// against, if one has been installed with SetSandbox. A nil fileSandbox
+// preserves today's unrestricted behavior.
+var fileSandbox *Sandbox
+
+// SetSandbox installs (or, with a nil argument, removes) the sandbox that
+// file:// imports are checked against.
+func SetSandbox(sb *Sandbox) {
+	fileSandbox = sb
+}
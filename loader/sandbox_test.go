@@ -0,0 +1,123 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSandbox(t *testing.T) (root string, sb *Sandbox, cleanup func()) {
+	t.Helper()
+	base, err := ioutil.TempDir("", "k6-sandbox-test")
+	require.NoError(t, err)
+
+	root = filepath.Join(base, "root")
+	require.NoError(t, os.MkdirAll(root, 0o755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "main.js"), []byte("inside"), 0o644))
+
+	outside := filepath.Join(base, "outside")
+	require.NoError(t, os.MkdirAll(outside, 0o755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outside, "secret.js"), []byte("outside"), 0o644))
+
+	sb, err = NewSandbox(root)
+	require.NoError(t, err)
+
+	return root, sb, func() { _ = os.RemoveAll(base) }
+}
+
+func TestSandboxCheckPathAllowsInsideRoot(t *testing.T) {
+	root, sb, cleanup := newTestSandbox(t)
+	defer cleanup()
+
+	assert.NoError(t, sb.CheckPath(filepath.Join(root, "main.js")))
+	assert.NoError(t, sb.CheckPath(filepath.Join(root, "sub", "dir", "mod.js")))
+}
+
+func TestSandboxCheckPathRejectsDotDotEscape(t *testing.T) {
+	root, sb, cleanup := newTestSandbox(t)
+	defer cleanup()
+
+	err := sb.CheckPath(filepath.Join(root, "..", "outside", "secret.js"))
+	assert.IsType(t, &ErrImportOutsideRoot{}, err)
+}
+
+func TestSandboxCheckPathRejectsAbsoluteEscape(t *testing.T) {
+	_, sb, cleanup := newTestSandbox(t)
+	defer cleanup()
+
+	err := sb.CheckPath(filepath.Join(os.TempDir(), "some-other-place", "mod.js"))
+	assert.IsType(t, &ErrImportOutsideRoot{}, err)
+}
+
+func TestSandboxOpenAllowsFileInsideRoot(t *testing.T) {
+	root, sb, cleanup := newTestSandbox(t)
+	defer cleanup()
+
+	f, err := sb.Open(filepath.Join(root, "main.js"))
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "inside", string(data))
+}
+
+func TestSandboxOpenRejectsSymlinkEscape(t *testing.T) {
+	root, sb, cleanup := newTestSandbox(t)
+	defer cleanup()
+
+	link := filepath.Join(root, "escape.js")
+	target := filepath.Join(filepath.Dir(root), "outside", "secret.js")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks unsupported on this filesystem: %v", err)
+	}
+
+	_, err := sb.Open(link)
+	assert.IsType(t, &ErrImportOutsideRoot{}, err)
+}
+
+func TestSandboxAllowsExtraDirectories(t *testing.T) {
+	root, _, cleanup := newTestSandbox(t)
+	defer cleanup()
+
+	shared := filepath.Join(filepath.Dir(root), "shared")
+	require.NoError(t, os.MkdirAll(shared, 0o755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(shared, "fixture.js"), []byte("shared"), 0o644))
+
+	sb, err := NewSandbox(root, shared)
+	require.NoError(t, err)
+
+	assert.NoError(t, sb.CheckPath(filepath.Join(shared, "fixture.js")))
+
+	f, err := sb.Open(filepath.Join(shared, "fixture.js"))
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "shared", string(data))
+}